@@ -0,0 +1,465 @@
+package logcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/log-cache/internal/pkg/logging"
+	rpc "code.cloudfoundry.org/log-cache/rpc/logcache_v1"
+	"github.com/golang/snappy"
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Gateway upgrades plain HTTP requests for LogCache into gRPC requests.
+type Gateway struct {
+	logCacheAddr string
+	addr         string
+	version      string
+
+	dialOpts []grpc.DialOption
+
+	remoteReadEnabled bool
+
+	lis    net.Listener
+	server *http.Server
+	logger *slog.Logger
+
+	conn   *grpc.ClientConn
+	egress rpc.EgressClient
+	promql rpc.PromQLQuerierClient
+}
+
+// GatewayOption configures a Gateway.
+type GatewayOption func(*Gateway)
+
+// WithGatewayLogCacheDialOpts sets the gRPC dial options used to connect
+// to the upstream LogCache.
+func WithGatewayLogCacheDialOpts(opts ...grpc.DialOption) GatewayOption {
+	return func(g *Gateway) {
+		g.dialOpts = opts
+	}
+}
+
+// WithGatewayVersion sets the version reported from api/v1/info.
+func WithGatewayVersion(v string) GatewayOption {
+	return func(g *Gateway) {
+		g.version = v
+	}
+}
+
+// WithGatewayRemoteReadEnabled turns on the Prometheus remote_read
+// endpoint at /api/v1/read, letting external Prometheus servers and
+// Grafana federate historical reads from LogCache. It is off by default
+// because, unlike the other endpoints, it requires clients to speak
+// Prometheus' snappy-compressed protobuf wire format rather than JSON.
+func WithGatewayRemoteReadEnabled() GatewayOption {
+	return func(g *Gateway) {
+		g.remoteReadEnabled = true
+	}
+}
+
+// WithGatewayLogger sets the logger Gateway reports errors through. A nil
+// logger (or not passing this option) falls back to a text handler on
+// stderr.
+func WithGatewayLogger(logger *slog.Logger) GatewayOption {
+	return func(g *Gateway) {
+		if logger == nil {
+			logger = logging.Default()
+		}
+		g.logger = logger
+	}
+}
+
+// WithGatewayLog adapts a *log.Logger to the slog-based logger
+// WithGatewayLogger expects, for callers that haven't migrated off the
+// standard library logger yet.
+func WithGatewayLog(l *stdlog.Logger) GatewayOption {
+	return func(g *Gateway) {
+		g.logger = logging.FromStdLog(l)
+	}
+}
+
+// NewGateway returns a new Gateway that upgrades HTTP requests received
+// on addr into gRPC requests against the LogCache at logCacheAddr.
+func NewGateway(logCacheAddr, addr string, opts ...GatewayOption) *Gateway {
+	g := &Gateway{
+		logCacheAddr: logCacheAddr,
+		addr:         addr,
+		logger:       logging.Default(),
+	}
+
+	for _, opt := range opts {
+		opt(g)
+	}
+
+	return g
+}
+
+// Start dials the upstream LogCache and starts serving HTTP. It does not
+// block.
+func (g *Gateway) Start() {
+	conn, err := grpc.Dial(g.logCacheAddr, g.dialOpts...)
+	if err != nil {
+		g.logger.Error("failed to dial log-cache", "err", err, "addr", g.logCacheAddr)
+		os.Exit(1)
+	}
+	g.conn = conn
+	g.egress = rpc.NewEgressClient(conn)
+	g.promql = rpc.NewPromQLQuerierClient(conn)
+
+	lis, err := net.Listen("tcp", g.addr)
+	if err != nil {
+		g.logger.Error("failed to listen", "err", err, "addr", g.addr)
+		os.Exit(1)
+	}
+	g.lis = lis
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/read/", g.handleRead)
+	mux.HandleFunc("/api/v1/meta", g.handleMeta)
+	mux.HandleFunc("/api/v1/query", g.handleInstantQuery)
+	mux.HandleFunc("/api/v1/query_range", g.handleRangeQuery)
+	mux.HandleFunc("/api/v1/info", g.handleInfo)
+	if g.remoteReadEnabled {
+		mux.HandleFunc("/api/v1/read", g.handleRemoteRead)
+	}
+
+	g.server = &http.Server{Handler: mux}
+
+	go g.server.Serve(lis)
+}
+
+// Addr returns the address the Gateway is serving HTTP on.
+func (g *Gateway) Addr() string {
+	return g.lis.Addr().String()
+}
+
+// Close stops serving HTTP and closes the upstream LogCache connection.
+func (g *Gateway) Close() error {
+	if g.server != nil {
+		g.server.Close()
+	}
+	if g.conn != nil {
+		return g.conn.Close()
+	}
+	return nil
+}
+
+func (g *Gateway) handleRead(w http.ResponseWriter, r *http.Request) {
+	sourceID, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/api/v1/read/"))
+	if err != nil {
+		g.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	q := r.URL.Query()
+
+	req := &rpc.ReadRequest{
+		SourceId:  sourceID,
+		StartTime: parseInt64(q.Get("start_time")),
+		EndTime:   parseInt64(q.Get("end_time")),
+		Limit:     parseInt64(q.Get("limit")),
+	}
+
+	for _, t := range q["envelope_types"] {
+		if et, ok := rpc.EnvelopeType_value[t]; ok {
+			req.EnvelopeTypes = append(req.EnvelopeTypes, rpc.EnvelopeType(et))
+		}
+	}
+
+	resp, err := g.egress.Read(r.Context(), req)
+	if err != nil {
+		g.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	g.writeJSON(w, http.StatusOK, resp)
+}
+
+func (g *Gateway) handleMeta(w http.ResponseWriter, r *http.Request) {
+	resp, err := g.egress.Meta(r.Context(), &rpc.MetaRequest{})
+	if err != nil {
+		g.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	g.writeJSON(w, http.StatusOK, resp)
+}
+
+func (g *Gateway) handleInstantQuery(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	resp, err := g.promql.InstantQuery(r.Context(), &rpc.PromQL_InstantQueryRequest{
+		Query: q.Get("query"),
+		Time:  q.Get("time"),
+	})
+	if err != nil {
+		g.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	g.writeJSON(w, http.StatusOK, promQLSuccess(resp))
+}
+
+func (g *Gateway) handleRangeQuery(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	resp, err := g.promql.RangeQuery(r.Context(), &rpc.PromQL_RangeQueryRequest{
+		Query: q.Get("query"),
+		Start: q.Get("start"),
+		End:   q.Get("end"),
+		Step:  q.Get("step"),
+	})
+	if err != nil {
+		g.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	g.writeJSON(w, http.StatusOK, promQLSuccess(resp))
+}
+
+func (g *Gateway) handleInfo(w http.ResponseWriter, r *http.Request) {
+	g.writeJSON(w, http.StatusOK, map[string]string{"version": g.version})
+}
+
+// promQLSuccess wraps a PromQL result in the envelope Prometheus' HTTP
+// API uses for successful responses.
+func promQLSuccess(result interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"status": "success",
+		"data":   result,
+	}
+}
+
+func (g *Gateway) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (g *Gateway) writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":    "error",
+		"errorType": "internal",
+		"error":     err.Error(),
+	})
+}
+
+func parseInt64(s string) int64 {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// handleRemoteRead implements Prometheus' remote_read protocol: a
+// snappy-compressed protobuf ReadRequest in, a snappy-compressed
+// protobuf ReadResponse out. It lets external Prometheus servers and
+// Grafana federate historical reads from LogCache without going through
+// the ad-hoc /api/v1/read/{source_id} path.
+func (g *Gateway) handleRemoteRead(w http.ResponseWriter, r *http.Request) {
+	if !acceptsSnappyProtobuf(r) {
+		g.writeError(w, http.StatusBadRequest, fmt.Errorf("unsupported content negotiation"))
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		g.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		g.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var req prompb.ReadRequest
+	if err := proto.Unmarshal(data, &req); err != nil {
+		g.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	resp := &prompb.ReadResponse{}
+	for _, q := range req.GetQueries() {
+		ts, err := g.remoteReadQuery(r.Context(), q)
+		if err != nil {
+			g.writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		resp.Results = append(resp.Results, &prompb.QueryResult{Timeseries: ts})
+	}
+
+	out, err := proto.Marshal(resp)
+	if err != nil {
+		g.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	w.WriteHeader(http.StatusOK)
+	w.Write(snappy.Encode(nil, out))
+}
+
+// remoteReadQuery translates a single Prometheus remote_read Query into
+// a LogCache Read call, filters the result by any remaining label
+// matchers, and converts the envelopes into Prometheus TimeSeries.
+func (g *Gateway) remoteReadQuery(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeries, error) {
+	readReq := &rpc.ReadRequest{
+		StartTime: q.GetStartTimestampMs() * int64(time.Millisecond),
+		EndTime:   q.GetEndTimestampMs() * int64(time.Millisecond),
+		EnvelopeTypes: []rpc.EnvelopeType{
+			rpc.EnvelopeType_GAUGE,
+			rpc.EnvelopeType_COUNTER,
+		},
+	}
+
+	var nameMatcher *prompb.LabelMatcher
+	var labelMatchers []*prompb.LabelMatcher
+	for _, m := range q.GetMatchers() {
+		switch m.GetName() {
+		case "__name__":
+			nameMatcher = m
+		case "source_id":
+			readReq.SourceId = m.GetValue()
+		default:
+			labelMatchers = append(labelMatchers, m)
+		}
+	}
+
+	resp, err := g.egress.Read(ctx, readReq)
+	if err != nil {
+		return nil, err
+	}
+
+	series := map[string]*prompb.TimeSeries{}
+	for _, e := range resp.GetEnvelopes().GetBatch() {
+		tags := envelopeTags(e)
+		if !matchesAll(tags, labelMatchers) {
+			continue
+		}
+
+		for name, value := range envelopeMetrics(e) {
+			if nameMatcher != nil && !matchesOne(name, nameMatcher) {
+				continue
+			}
+
+			key := name + "|" + mapKey(tags)
+			ts, ok := series[key]
+			if !ok {
+				ts = &prompb.TimeSeries{Labels: labelsFor(name, tags)}
+				series[key] = ts
+			}
+
+			ts.Samples = append(ts.Samples, prompb.Sample{
+				Value:     value,
+				Timestamp: e.GetTimestamp() / int64(time.Millisecond),
+			})
+		}
+	}
+
+	result := make([]*prompb.TimeSeries, 0, len(series))
+	for _, ts := range series {
+		result = append(result, ts)
+	}
+
+	return result, nil
+}
+
+func envelopeTags(e *rpc.Envelope) map[string]string {
+	tags := map[string]string{}
+	for k, v := range e.GetTags() {
+		tags[k] = v
+	}
+	tags["source_id"] = e.GetSourceId()
+	return tags
+}
+
+// envelopeMetrics returns every named metric carried by e. A Gauge
+// envelope can report more than one named metric at once, so all of them
+// are returned rather than an arbitrary one - the __name__ matcher in
+// remoteReadQuery is what narrows this down to the metric a query
+// actually asked for.
+func envelopeMetrics(e *rpc.Envelope) map[string]float64 {
+	switch m := e.GetMessage().(type) {
+	case *rpc.Envelope_Gauge:
+		metrics := make(map[string]float64, len(m.Gauge.GetMetrics()))
+		for name, metric := range m.Gauge.GetMetrics() {
+			metrics[name] = metric.GetValue()
+		}
+		return metrics
+	case *rpc.Envelope_Counter:
+		return map[string]float64{m.Counter.GetName(): float64(m.Counter.GetTotal())}
+	}
+	return nil
+}
+
+func matchesAll(tags map[string]string, matchers []*prompb.LabelMatcher) bool {
+	for _, m := range matchers {
+		if !matchesOne(tags[m.GetName()], m) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesOne(value string, m *prompb.LabelMatcher) bool {
+	switch m.GetType() {
+	case prompb.LabelMatcher_EQ:
+		return value == m.GetValue()
+	case prompb.LabelMatcher_NEQ:
+		return value != m.GetValue()
+	default:
+		// RE/NRE matchers aren't needed by any known remote_read client
+		// of LogCache today; treat them as non-matching rather than
+		// silently returning unfiltered data.
+		return false
+	}
+}
+
+func labelsFor(name string, tags map[string]string) []*prompb.Label {
+	labels := []*prompb.Label{{Name: "__name__", Value: name}}
+	for k, v := range tags {
+		labels = append(labels, &prompb.Label{Name: k, Value: v})
+	}
+	return labels
+}
+
+func mapKey(m map[string]string) string {
+	var sb strings.Builder
+	for k, v := range m {
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(v)
+		sb.WriteByte(';')
+	}
+	return sb.String()
+}
+
+// acceptsSnappyProtobuf validates the request against Prometheus'
+// remote_read content negotiation: application/x-protobuf with snappy
+// encoding. A request with no Content-Encoding header is also accepted,
+// and its body is still decoded as snappy.
+func acceptsSnappyProtobuf(r *http.Request) bool {
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/x-protobuf") {
+		return false
+	}
+	enc := r.Header.Get("Content-Encoding")
+	return enc == "" || enc == "snappy"
+}
@@ -0,0 +1,95 @@
+package logcache
+
+import (
+	"testing"
+
+	rpc "code.cloudfoundry.org/log-cache/rpc/logcache_v1"
+	"github.com/prometheus/prometheus/prompb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// TestEnvelopeMetricsReturnsEveryNamedMetric guards against silently
+// keeping only one of several named metrics a single Gauge envelope
+// reports - which entry survived used to depend on Go's randomized map
+// iteration order.
+func TestEnvelopeMetricsReturnsEveryNamedMetric(t *testing.T) {
+	e := &rpc.Envelope{
+		Message: &rpc.Envelope_Gauge{
+			Gauge: &rpc.Gauge{
+				Metrics: map[string]*rpc.GaugeValue{
+					"up":      {Value: 1},
+					"latency": {Value: 42},
+				},
+			},
+		},
+	}
+
+	metrics := envelopeMetrics(e)
+
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(metrics))
+	}
+	if metrics["up"] != 1 {
+		t.Errorf("expected up=1, got %v", metrics["up"])
+	}
+	if metrics["latency"] != 42 {
+		t.Errorf("expected latency=42, got %v", metrics["latency"])
+	}
+}
+
+// TestRemoteReadQueryFiltersByName ensures a __name__ matcher selects the
+// matching metric out of a multi-metric envelope instead of the matcher
+// being dropped on the floor and an arbitrary metric winning.
+func TestRemoteReadQueryFiltersByName(t *testing.T) {
+	egress := &stubEgressClient{
+		readResponse: &rpc.ReadResponse{
+			Envelopes: &rpc.EnvelopeBatch{
+				Batch: []*rpc.Envelope{
+					{
+						SourceId: "some-source",
+						Message: &rpc.Envelope_Gauge{
+							Gauge: &rpc.Gauge{
+								Metrics: map[string]*rpc.GaugeValue{
+									"up":      {Value: 1},
+									"latency": {Value: 42},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	g := &Gateway{egress: egress}
+
+	series, err := g.remoteReadQuery(context.Background(), &prompb.Query{
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+			{Type: prompb.LabelMatcher_EQ, Name: "source_id", Value: "some-source"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(series) != 1 {
+		t.Fatalf("expected exactly one series matching __name__=up, got %d", len(series))
+	}
+
+	for _, l := range series[0].Labels {
+		if l.Name == "__name__" && l.Value != "up" {
+			t.Errorf("expected __name__=up, got %s", l.Value)
+		}
+	}
+}
+
+type stubEgressClient struct {
+	rpc.EgressClient
+	readResponse *rpc.ReadResponse
+}
+
+func (s *stubEgressClient) Read(ctx context.Context, in *rpc.ReadRequest, opts ...grpc.CallOption) (*rpc.ReadResponse, error) {
+	return s.readResponse, nil
+}
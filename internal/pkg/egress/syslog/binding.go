@@ -0,0 +1,28 @@
+package syslog
+
+import "crypto/tls"
+
+// Binding describes a single syslog drain: where to ship envelopes and
+// which source they should be filtered to.
+type Binding struct {
+	// DrainURL is the destination, e.g. syslog://, syslog-tls://, or
+	// https:// for a drain that accepts batched HTTPS POSTs.
+	DrainURL string
+
+	// AppID (or, for platform components, SourceID) restricts this
+	// binding to envelopes from a single source.
+	AppID string
+
+	// Hostname is reported in the RFC-5424 HOSTNAME field.
+	Hostname string
+
+	// TLSConfig is used for syslog-tls:// and https:// drains.
+	TLSConfig *tls.Config
+}
+
+// BindingReader supplies the current set of syslog bindings. It is
+// pluggable so a future controller can hot-reload drains (e.g. from a
+// CC-managed store) without restarting the process.
+type BindingReader interface {
+	FetchBindings() ([]Binding, error)
+}
@@ -0,0 +1,201 @@
+package syslog
+
+import (
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/log-cache/internal/pkg/logging"
+	rpc "code.cloudfoundry.org/log-cache/rpc/logcache_v1"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Reader reads envelopes out of the local log-cache store. It is
+// satisfied by rpc.EgressClient.
+type Reader interface {
+	Read(ctx context.Context, in *rpc.ReadRequest, opts ...grpc.CallOption) (*rpc.ReadResponse, error)
+}
+
+// DrainManager periodically reads cached envelopes for every bound
+// source and ships them to that binding's syslog drain. Bindings are
+// re-fetched from a BindingReader on every poll, so drains can be added,
+// removed, or updated without restarting the process.
+type DrainManager struct {
+	reader   Reader
+	bindings BindingReader
+	metrics  Metrics
+
+	pollInterval  time.Duration
+	batchSize     int
+	flushInterval time.Duration
+	sendTimeout   time.Duration
+
+	drains      map[drainKey]*DrainWriter
+	lastReadEnd map[drainKey]int64
+
+	logger *slog.Logger
+}
+
+// drainKey identifies a single binding's drain. DrainURL alone isn't
+// enough: the same drain URL can be bound to more than one app, and each
+// such binding needs its own DrainWriter (so envelopes are stamped with
+// the right AppID/Hostname) and its own read watermark.
+type drainKey struct {
+	drainURL string
+	appID    string
+}
+
+func keyFor(b Binding) drainKey {
+	return drainKey{drainURL: b.DrainURL, appID: b.AppID}
+}
+
+// NewDrainManager returns a DrainManager that polls reader for envelopes
+// on pollInterval and fans them out to the bindings returned by bindings.
+// A nil logger falls back to a text handler on stderr.
+func NewDrainManager(
+	reader Reader,
+	bindings BindingReader,
+	metrics Metrics,
+	pollInterval time.Duration,
+	batchSize int,
+	flushInterval time.Duration,
+	sendTimeout time.Duration,
+	logger *slog.Logger,
+) *DrainManager {
+	if logger == nil {
+		logger = logging.Default()
+	}
+
+	return &DrainManager{
+		reader:        reader,
+		bindings:      bindings,
+		metrics:       metrics,
+		pollInterval:  pollInterval,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		sendTimeout:   sendTimeout,
+		drains:        make(map[drainKey]*DrainWriter),
+		lastReadEnd:   make(map[drainKey]int64),
+		logger:        logger,
+	}
+}
+
+// Run polls for bindings and cached envelopes until ctx is canceled.
+func (m *DrainManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.poll(ctx)
+		}
+	}
+}
+
+// poll re-syncs the drain set with the current bindings, then reads and
+// forwards any new envelopes for each one. Each binding's read window
+// starts where its last successful read left off, rather than a fixed
+// pollInterval back from now, so a slow or skipped poll cycle can't open
+// a gap that silently drops envelopes.
+func (m *DrainManager) poll(ctx context.Context) {
+	bindings, err := m.bindings.FetchBindings()
+	if err != nil {
+		m.logger.Error("failed to fetch syslog bindings", "err", err)
+		return
+	}
+
+	m.syncDrains(bindings)
+
+	for _, b := range bindings {
+		key := keyFor(b)
+
+		drain, ok := m.drains[key]
+		if !ok {
+			continue
+		}
+
+		start, ok := m.lastReadEnd[key]
+		if !ok {
+			start = time.Now().Add(-m.pollInterval).UnixNano()
+		}
+		end := time.Now().UnixNano()
+
+		resp, err := m.reader.Read(ctx, &rpc.ReadRequest{
+			SourceId:  b.AppID,
+			StartTime: start,
+			EndTime:   end,
+		})
+		if err != nil {
+			m.logger.Error("failed to read envelopes for drain", "err", err, "target", b.DrainURL)
+			continue
+		}
+
+		m.lastReadEnd[key] = end
+
+		for _, e := range resp.GetEnvelopes().GetBatch() {
+			drain.Write(e)
+		}
+	}
+}
+
+// syncDrains creates a DrainWriter (and underlying Writer) for any new
+// binding and tears down any that have been removed, so a future
+// controller can hot-reload drains without a restart. Bindings are keyed
+// by (DrainURL, AppID), since the same drain URL can be bound to more
+// than one app and each needs its own writer and read watermark.
+func (m *DrainManager) syncDrains(bindings []Binding) {
+	seen := map[drainKey]bool{}
+
+	for _, b := range bindings {
+		key := keyFor(b)
+		seen[key] = true
+		if _, ok := m.drains[key]; ok {
+			continue
+		}
+
+		writer, err := m.newWriter(b)
+		if err != nil {
+			m.logger.Error("failed to create writer for drain", "err", err, "target", b.DrainURL)
+			continue
+		}
+
+		m.drains[key] = NewDrainWriter(b, writer, m.metrics, m.batchSize, m.flushInterval, m.logger)
+	}
+
+	for key, drain := range m.drains {
+		if !seen[key] {
+			drain.Stop()
+			delete(m.drains, key)
+			delete(m.lastReadEnd, key)
+		}
+	}
+}
+
+func (m *DrainManager) newWriter(b Binding) (Writer, error) {
+	u, err := url.Parse(b.DrainURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasPrefix(u.Scheme, "syslog"):
+		return NewTCPWriter(b, m.sendTimeout)
+	case u.Scheme == "https":
+		return NewHTTPSWriter(b, m.sendTimeout, m.metrics), nil
+	default:
+		return nil, &unsupportedSchemeError{scheme: u.Scheme}
+	}
+}
+
+type unsupportedSchemeError struct {
+	scheme string
+}
+
+func (e *unsupportedSchemeError) Error() string {
+	return "unsupported drain scheme: " + e.scheme
+}
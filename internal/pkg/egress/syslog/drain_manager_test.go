@@ -0,0 +1,146 @@
+package syslog_test
+
+import (
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/log-cache/internal/pkg/egress/syslog"
+	rpc "code.cloudfoundry.org/log-cache/rpc/logcache_v1"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DrainManager", func() {
+	var (
+		reader   *spyReader
+		bindings *stubBindingReader
+		metrics  *spyWriterMetrics
+		ctx      context.Context
+		cancel   context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		reader = newSpyReader()
+		bindings = newStubBindingReader()
+		metrics = newSpyWriterMetrics()
+		ctx, cancel = context.WithCancel(context.Background())
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("advances each binding's read window from its own last read, instead of a fixed window back from now", func() {
+		bindings.set([]syslog.Binding{
+			{DrainURL: "syslog://127.0.0.1:1", AppID: "some-app", Hostname: "some-host"},
+		})
+
+		m := syslog.NewDrainManager(reader, bindings, metrics, 10*time.Millisecond, 10, time.Hour, time.Second, nil)
+		go m.Run(ctx)
+
+		Eventually(func() int { return len(reader.calls()) }, time.Second).Should(BeNumerically(">=", 2))
+
+		calls := reader.calls()
+		for i := 1; i < len(calls); i++ {
+			Expect(calls[i].StartTime).To(Equal(calls[i-1].EndTime))
+		}
+	})
+
+	It("tracks a separate read watermark per app when bindings share a drain URL", func() {
+		bindings.set([]syslog.Binding{
+			{DrainURL: "syslog://127.0.0.1:1", AppID: "app-a", Hostname: "host-a"},
+			{DrainURL: "syslog://127.0.0.1:1", AppID: "app-b", Hostname: "host-b"},
+		})
+
+		m := syslog.NewDrainManager(reader, bindings, metrics, 10*time.Millisecond, 10, time.Hour, time.Second, nil)
+		go m.Run(ctx)
+
+		Eventually(func() int { return len(reader.callsFor("app-a")) }, time.Second).Should(BeNumerically(">=", 2))
+		Eventually(func() int { return len(reader.callsFor("app-b")) }, time.Second).Should(BeNumerically(">=", 2))
+
+		for _, appID := range []string{"app-a", "app-b"} {
+			calls := reader.callsFor(appID)
+			for i := 1; i < len(calls); i++ {
+				Expect(calls[i].StartTime).To(Equal(calls[i-1].EndTime))
+			}
+		}
+	})
+
+	It("stops reading for a binding once it's removed", func() {
+		bindings.set([]syslog.Binding{
+			{DrainURL: "syslog://127.0.0.1:1", AppID: "some-app", Hostname: "some-host"},
+		})
+
+		m := syslog.NewDrainManager(reader, bindings, metrics, 10*time.Millisecond, 10, time.Hour, time.Second, nil)
+		go m.Run(ctx)
+
+		Eventually(func() int { return len(reader.calls()) }, time.Second).Should(BeNumerically(">=", 1))
+
+		bindings.set(nil)
+		time.Sleep(50 * time.Millisecond) // let the removal take effect on the next poll
+
+		countAfterRemoval := len(reader.calls())
+
+		Consistently(func() int { return len(reader.calls()) }, 100*time.Millisecond).Should(Equal(countAfterRemoval))
+	})
+})
+
+type spyReader struct {
+	mu    sync.Mutex
+	reads []*rpc.ReadRequest
+}
+
+func newSpyReader() *spyReader {
+	return &spyReader{}
+}
+
+func (s *spyReader) Read(ctx context.Context, in *rpc.ReadRequest, opts ...grpc.CallOption) (*rpc.ReadResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads = append(s.reads, in)
+	return &rpc.ReadResponse{}, nil
+}
+
+func (s *spyReader) calls() []*rpc.ReadRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*rpc.ReadRequest, len(s.reads))
+	copy(out, s.reads)
+	return out
+}
+
+func (s *spyReader) callsFor(sourceID string) []*rpc.ReadRequest {
+	var out []*rpc.ReadRequest
+	for _, r := range s.calls() {
+		if r.SourceId == sourceID {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+type stubBindingReader struct {
+	mu       sync.Mutex
+	bindings []syslog.Binding
+}
+
+func newStubBindingReader() *stubBindingReader {
+	return &stubBindingReader{}
+}
+
+func (s *stubBindingReader) set(bindings []syslog.Binding) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bindings = bindings
+}
+
+func (s *stubBindingReader) FetchBindings() ([]syslog.Binding, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]syslog.Binding, len(s.bindings))
+	copy(out, s.bindings)
+	return out, nil
+}
@@ -0,0 +1,64 @@
+package syslog
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// HTTPSWriter POSTs newline-separated, RFC-5424 formatted syslog messages
+// to an HTTPS drain. It reuses fasthttp.Request/Response via
+// Acquire/Release so the hot path doesn't allocate.
+type HTTPSWriter struct {
+	url                 string
+	client              *fasthttp.Client
+	sendTimeoutDuration time.Duration
+
+	sendDuration func(d float64)
+}
+
+// NewHTTPSWriter returns an HTTPSWriter that POSTs batches to the https://
+// drain described by binding.
+func NewHTTPSWriter(binding Binding, sendTimeout time.Duration, m Metrics) *HTTPSWriter {
+	w := &HTTPSWriter{
+		url:                 binding.DrainURL,
+		sendTimeoutDuration: sendTimeout,
+		client: &fasthttp.Client{
+			TLSConfig: binding.TLSConfig,
+		},
+	}
+
+	durations := m.NewCounter("SendDuration")
+	w.sendDuration = func(d float64) { durations(uint64(d)) }
+
+	return w
+}
+
+// Write POSTs batch as the request body, reusing pooled
+// fasthttp.Request/Response objects for the hot path.
+func (w *HTTPSWriter) Write(batch []byte) error {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(w.url)
+	req.Header.SetMethod("POST")
+	req.Header.SetContentType("text/plain")
+	req.SetBody(batch)
+
+	start := time.Now()
+	err := w.client.DoTimeout(req, resp, w.sendTimeoutDuration)
+	w.sendDuration(float64(time.Since(start)))
+
+	if err != nil {
+		return fmt.Errorf("failed to POST batch to %s: %s", w.url, err)
+	}
+
+	if resp.StatusCode() >= 300 {
+		return fmt.Errorf("drain %s responded with %d", w.url, resp.StatusCode())
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package syslog
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+)
+
+// formatEnvelope renders an envelope as an RFC-5424 syslog message. It
+// follows the same PRI/structured-data conventions loggregator's syslog
+// writers use so existing drains don't see a change in message shape.
+func formatEnvelope(e *loggregator_v2.Envelope, appID, hostname string) []byte {
+	msg := envelopeMessage(e)
+	if msg == "" {
+		return nil
+	}
+
+	ts := time.Unix(0, e.GetTimestamp()).UTC().Format(time.RFC3339Nano)
+	procID := e.GetSourceId()
+	if procID == "" {
+		procID = "-"
+	}
+
+	return []byte(fmt.Sprintf(
+		"<14>1 %s %s %s %s - - %s",
+		ts, hostname, appID, procID, msg,
+	))
+}
+
+// envelopeMessage extracts a human-readable payload from whichever
+// envelope type was given. A Gauge envelope can carry more than one
+// named metric at once, so all of them are rendered (sorted by name for
+// a stable message, since map iteration order isn't). Envelope types
+// with no natural log representation (timers, events) are skipped.
+func envelopeMessage(e *loggregator_v2.Envelope) string {
+	switch t := e.GetMessage().(type) {
+	case *loggregator_v2.Envelope_Log:
+		return string(t.Log.GetPayload())
+	case *loggregator_v2.Envelope_Gauge:
+		metrics := t.Gauge.GetMetrics()
+		names := make([]string, 0, len(metrics))
+		for name := range metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		pairs := make([]string, 0, len(names))
+		for _, name := range names {
+			m := metrics[name]
+			pairs = append(pairs, fmt.Sprintf("%s:%f %s", name, m.GetValue(), m.GetUnit()))
+		}
+		return strings.Join(pairs, " ")
+	case *loggregator_v2.Envelope_Counter:
+		return fmt.Sprintf("%s:%d", t.Counter.GetName(), t.Counter.GetTotal())
+	}
+
+	return ""
+}
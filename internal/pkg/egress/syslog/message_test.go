@@ -0,0 +1,29 @@
+package syslog
+
+import (
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+)
+
+func TestEnvelopeMessageRendersEveryGaugeMetric(t *testing.T) {
+	e := &loggregator_v2.Envelope{
+		Message: &loggregator_v2.Envelope_Gauge{
+			Gauge: &loggregator_v2.Gauge{
+				Metrics: map[string]*loggregator_v2.GaugeValue{
+					"cpu":    {Value: 1, Unit: "percent"},
+					"memory": {Value: 2, Unit: "bytes"},
+				},
+			},
+		},
+	}
+
+	msg := envelopeMessage(e)
+
+	for _, want := range []string{"cpu:1.000000 percent", "memory:2.000000 bytes"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("expected message %q to contain %q", msg, want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package syslog
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// TCPWriter writes batches to a syslog drain over a plain or TLS TCP
+// connection, reconnecting lazily the next time Write is called after a
+// failure.
+type TCPWriter struct {
+	mu          sync.Mutex
+	addr        string
+	tlsConfig   *tls.Config
+	sendTimeout time.Duration
+	conn        net.Conn
+}
+
+// NewTCPWriter returns a TCPWriter for the syslog:// or syslog-tls://
+// drain described by binding. tlsConfig is ignored for syslog:// drains.
+func NewTCPWriter(binding Binding, sendTimeout time.Duration) (*TCPWriter, error) {
+	u, err := url.Parse(binding.DrainURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid drain URL: %s", err)
+	}
+
+	w := &TCPWriter{
+		addr:        u.Host,
+		sendTimeout: sendTimeout,
+	}
+
+	if u.Scheme == "syslog-tls" {
+		w.tlsConfig = binding.TLSConfig
+	}
+
+	return w, nil
+}
+
+// Write writes batch to the drain, dialing (or re-dialing, after a prior
+// failure) as necessary.
+func (w *TCPWriter) Write(batch []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn == nil {
+		if err := w.dial(); err != nil {
+			return err
+		}
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(w.sendTimeout))
+	if _, err := w.conn.Write(append(batch, '\n')); err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+func (w *TCPWriter) dial() error {
+	var conn net.Conn
+	var err error
+
+	if w.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: w.sendTimeout}, "tcp", w.addr, w.tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", w.addr, w.sendTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to dial %s: %s", w.addr, err)
+	}
+
+	w.conn = conn
+	return nil
+}
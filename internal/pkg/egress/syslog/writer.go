@@ -0,0 +1,159 @@
+package syslog
+
+import (
+	"bytes"
+	"log/slog"
+	"time"
+
+	diodes "code.cloudfoundry.org/go-diodes"
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"code.cloudfoundry.org/log-cache/internal/pkg/logging"
+	"golang.org/x/net/context"
+)
+
+// Writer ships a single batch of newline-separated, RFC-5424 formatted
+// syslog messages to a bound drain.
+type Writer interface {
+	Write(batch []byte) error
+}
+
+// Metrics registers the counters and duration metrics egress writers
+// report through. It mirrors the Metrics interface in package routing.
+type Metrics interface {
+	NewCounter(name string) func(delta uint64)
+}
+
+// DrainWriter buffers envelopes for a single binding and periodically
+// flushes them to a Writer in batches. It buffers with the same
+// drop-oldest diode BatchedIngressClient uses, so a slow or unreachable
+// drain applies backpressure to itself rather than to cache reads.
+type DrainWriter struct {
+	binding Binding
+	writer  Writer
+	buffer  *diodes.OneToOne
+
+	batchSize     int
+	flushInterval time.Duration
+
+	messagesSent    func(uint64)
+	messagesDropped func(uint64)
+
+	logger *slog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewDrainWriter returns a DrainWriter that formats and forwards
+// envelopes for binding to w. A nil logger falls back to a text handler
+// on stderr.
+func NewDrainWriter(
+	binding Binding,
+	w Writer,
+	m Metrics,
+	batchSize int,
+	flushInterval time.Duration,
+	logger *slog.Logger,
+) *DrainWriter {
+	if logger == nil {
+		logger = logging.Default()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &DrainWriter{
+		binding:       binding,
+		writer:        w,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		logger:        logger,
+
+		messagesSent:    m.NewCounter("MessagesSent"),
+		messagesDropped: m.NewCounter("MessagesDropped"),
+
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	d.buffer = diodes.NewOneToOne(1000, diodes.AlertFunc(func(missed int) {
+		logger.Warn("dropped envelopes", "count", missed, "source", "drain", "drain_url", binding.DrainURL)
+		d.messagesDropped(uint64(missed))
+	}))
+
+	go d.start()
+
+	return d
+}
+
+// Stop cancels the DrainWriter's delivery loop and blocks until it has
+// flushed any batched envelopes and exited, so a removed binding leaves
+// behind no running goroutine or open connection.
+func (d *DrainWriter) Stop() {
+	d.cancel()
+	<-d.done
+}
+
+// Write enqueues an envelope for delivery. It never blocks: once the
+// internal diode is full, the oldest buffered envelope is overwritten and
+// MessagesDropped is incremented.
+func (d *DrainWriter) Write(e *loggregator_v2.Envelope) {
+	d.buffer.Set(diodes.GenericDataType(e))
+}
+
+func (d *DrainWriter) start() {
+	defer close(d.done)
+
+	var batch [][]byte
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := d.writer.Write(bytes.Join(batch, []byte("\n"))); err != nil {
+			d.logger.Error("send failed", "err", err, "batch_size", len(batch), "target", d.binding.DrainURL)
+		} else {
+			d.messagesSent(uint64(len(batch)))
+		}
+
+		batch = nil
+	}
+
+	ticker := time.NewTicker(d.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			flush()
+			return
+		default:
+		}
+
+		e, ok := d.buffer.TryNext()
+		if !ok {
+			select {
+			case <-d.ctx.Done():
+				flush()
+				return
+			case <-ticker.C:
+				flush()
+			default:
+				time.Sleep(10 * time.Millisecond)
+			}
+			continue
+		}
+
+		msg := formatEnvelope((*loggregator_v2.Envelope)(e), d.binding.AppID, d.binding.Hostname)
+		if msg == nil {
+			continue
+		}
+
+		batch = append(batch, msg)
+		if len(batch) >= d.batchSize {
+			flush()
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package syslog_test
+
+import (
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"code.cloudfoundry.org/log-cache/internal/pkg/egress/syslog"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DrainWriter", func() {
+	var (
+		writer  *spyWriter
+		metrics *spyWriterMetrics
+		binding syslog.Binding
+	)
+
+	BeforeEach(func() {
+		writer = newSpyWriter()
+		metrics = newSpyWriterMetrics()
+		binding = syslog.Binding{DrainURL: "syslog://drain", AppID: "some-app", Hostname: "some-host"}
+	})
+
+	It("formats and forwards a written envelope", func() {
+		d := syslog.NewDrainWriter(binding, writer, metrics, 1, time.Millisecond, nil)
+		defer d.Stop()
+
+		d.Write(&loggregator_v2.Envelope{
+			SourceId: "some-app",
+			Message: &loggregator_v2.Envelope_Log{
+				Log: &loggregator_v2.Log{Payload: []byte("hello")},
+			},
+		})
+
+		Eventually(writer.batches).Should(HaveLen(1))
+		Expect(string(writer.batches()[0])).To(ContainSubstring("hello"))
+		Expect(string(writer.batches()[0])).To(ContainSubstring("some-host"))
+	})
+
+	It("drops the oldest envelope once its buffer is full, applying backpressure to itself rather than the caller", func() {
+		d := syslog.NewDrainWriter(binding, writer, metrics, 100000, time.Hour, nil)
+		defer d.Stop()
+
+		for i := 0; i < 2000; i++ {
+			d.Write(&loggregator_v2.Envelope{
+				SourceId: "some-app",
+				Message:  &loggregator_v2.Envelope_Log{Log: &loggregator_v2.Log{Payload: []byte("x")}},
+			})
+		}
+
+		Eventually(func() uint64 { return metrics.count("MessagesDropped") }).Should(BeNumerically(">", 0))
+	})
+
+	It("stops its delivery loop once Stop is called", func() {
+		d := syslog.NewDrainWriter(binding, writer, metrics, 1, time.Hour, nil)
+
+		done := make(chan struct{})
+		go func() {
+			d.Stop()
+			close(done)
+		}()
+
+		Eventually(done).Should(BeClosed())
+	})
+})
+
+type spyWriter struct {
+	mu   sync.Mutex
+	sent [][]byte
+}
+
+func newSpyWriter() *spyWriter {
+	return &spyWriter{}
+}
+
+func (s *spyWriter) Write(batch []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, batch)
+	return nil
+}
+
+func (s *spyWriter) batches() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([][]byte, len(s.sent))
+	copy(out, s.sent)
+	return out
+}
+
+type spyWriterMetrics struct {
+	mu       sync.Mutex
+	counters map[string]uint64
+}
+
+func newSpyWriterMetrics() *spyWriterMetrics {
+	return &spyWriterMetrics{counters: map[string]uint64{}}
+}
+
+func (s *spyWriterMetrics) NewCounter(name string) func(uint64) {
+	return func(delta uint64) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.counters[name] += delta
+	}
+}
+
+func (s *spyWriterMetrics) count(name string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counters[name]
+}
@@ -0,0 +1,127 @@
+// Package logging provides a small slog.Handler wrapper shared by the
+// routing and gateway packages.
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultDedupWindow is how long DedupHandler waits before emitting a
+// coalesced record when none is given to NewDedupHandler.
+const defaultDedupWindow = time.Second
+
+// DedupHandler wraps a slog.Handler and coalesces records that share the
+// same level, message, and set of attribute keys within a time window.
+// The first occurrence of a given key is always emitted immediately, so
+// a one-off record is never delayed or lost; any further occurrences
+// seen before the window closes are coalesced into a single follow-up
+// record carrying a "repeated" count. It exists to keep high-frequency,
+// repetitive logging (e.g. "dropped envelopes" under sustained overload)
+// from flooding output.
+type DedupHandler struct {
+	next   slog.Handler
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingRecord
+}
+
+type pendingRecord struct {
+	record slog.Record
+	count  int
+}
+
+// NewDedupHandler wraps next, coalescing matching records within the
+// default 1s window.
+func NewDedupHandler(next slog.Handler) *DedupHandler {
+	return NewDedupHandlerWithWindow(next, defaultDedupWindow)
+}
+
+// NewDedupHandlerWithWindow wraps next, coalescing matching records
+// within window.
+func NewDedupHandlerWithWindow(next slog.Handler, window time.Duration) *DedupHandler {
+	return &DedupHandler{
+		next:    next,
+		window:  window,
+		pending: make(map[string]*pendingRecord),
+	}
+}
+
+// Enabled reports whether the wrapped handler would log at level.
+func (h *DedupHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle emits r straight through to the wrapped handler the first time
+// its key is seen, then starts a timer for that key. Matching records
+// seen before the timer fires are coalesced and, if there were any,
+// flushed as a single follow-up record when the window closes. This
+// means a record is never held back waiting to see if it repeats -
+// important for one-off errors on a process-exit path, which must be
+// visible before the process exits.
+func (h *DedupHandler) Handle(ctx context.Context, r slog.Record) error {
+	key := dedupKey(r)
+
+	h.mu.Lock()
+	if p, ok := h.pending[key]; ok {
+		p.count++
+		h.mu.Unlock()
+		return nil
+	}
+
+	h.pending[key] = &pendingRecord{record: r.Clone(), count: 1}
+	h.mu.Unlock()
+
+	time.AfterFunc(h.window, func() { h.flush(key) })
+
+	return h.next.Handle(ctx, r)
+}
+
+func (h *DedupHandler) flush(key string) {
+	h.mu.Lock()
+	p, ok := h.pending[key]
+	if ok {
+		delete(h.pending, key)
+	}
+	h.mu.Unlock()
+
+	if !ok || p.count <= 1 {
+		return
+	}
+
+	record := p.record
+	record.AddAttrs(slog.Int("repeated", p.count-1))
+	h.next.Handle(context.Background(), record)
+}
+
+// WithAttrs returns a DedupHandler wrapping next.WithAttrs(attrs).
+func (h *DedupHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return NewDedupHandlerWithWindow(h.next.WithAttrs(attrs), h.window)
+}
+
+// WithGroup returns a DedupHandler wrapping next.WithGroup(name).
+func (h *DedupHandler) WithGroup(name string) slog.Handler {
+	return NewDedupHandlerWithWindow(h.next.WithGroup(name), h.window)
+}
+
+// dedupKey identifies records that should be coalesced: same level,
+// message, and set of attribute keys (not values, so e.g. varying error
+// strings for the same failure still dedup together).
+func dedupKey(r slog.Record) string {
+	var sb strings.Builder
+	sb.WriteString(r.Level.String())
+	sb.WriteByte('|')
+	sb.WriteString(r.Message)
+
+	r.Attrs(func(a slog.Attr) bool {
+		sb.WriteByte('|')
+		sb.WriteString(a.Key)
+		return true
+	})
+
+	return sb.String()
+}
@@ -0,0 +1,87 @@
+package logging_test
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/log-cache/internal/pkg/logging"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type spyHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (s *spyHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (s *spyHandler) Handle(_ context.Context, r slog.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *spyHandler) WithAttrs([]slog.Attr) slog.Handler { return s }
+func (s *spyHandler) WithGroup(string) slog.Handler      { return s }
+
+func (s *spyHandler) Records() []slog.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]slog.Record, len(s.records))
+	copy(out, s.records)
+	return out
+}
+
+var _ = Describe("DedupHandler", func() {
+	var (
+		spy     *spyHandler
+		handler *logging.DedupHandler
+	)
+
+	BeforeEach(func() {
+		spy = &spyHandler{}
+		handler = logging.NewDedupHandlerWithWindow(spy, 20*time.Millisecond)
+	})
+
+	It("emits the first occurrence of a record immediately", func() {
+		handler.Handle(context.Background(), slog.Record{Message: "boom", Level: slog.LevelError})
+
+		Expect(spy.Records()).To(HaveLen(1))
+	})
+
+	It("coalesces repeats seen within the window into a single follow-up record", func() {
+		for i := 0; i < 5; i++ {
+			handler.Handle(context.Background(), slog.Record{Message: "dropped envelopes", Level: slog.LevelWarn})
+		}
+
+		Eventually(func() int { return len(spy.Records()) }, time.Second).Should(Equal(2))
+
+		repeated, ok := attr(spy.Records()[1], "repeated")
+		Expect(ok).To(BeTrue())
+		Expect(repeated.Int64()).To(Equal(int64(4)))
+	})
+
+	It("does not emit a follow-up record when a key is only seen once", func() {
+		handler.Handle(context.Background(), slog.Record{Message: "boom", Level: slog.LevelError})
+
+		Consistently(func() int { return len(spy.Records()) }, 50*time.Millisecond).Should(Equal(1))
+	})
+})
+
+func attr(r slog.Record, key string) (slog.Value, bool) {
+	var v slog.Value
+	var ok bool
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == key {
+			v, ok = a.Value, true
+			return false
+		}
+		return true
+	})
+	return v, ok
+}
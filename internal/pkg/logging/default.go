@@ -0,0 +1,26 @@
+package logging
+
+import (
+	stdlog "log"
+	"log/slog"
+	"os"
+)
+
+// Default returns the logger constructors fall back to when given nil: a
+// text handler on stderr, wrapped in DedupHandler so repetitive messages
+// don't flood output under sustained overload.
+func Default() *slog.Logger {
+	return slog.New(NewDedupHandler(slog.NewTextHandler(os.Stderr, nil)))
+}
+
+// FromStdLog adapts a *log.Logger to a *slog.Logger, so code still
+// holding onto the pre-slog WithXxxLogger(*log.Logger) options can keep
+// working unchanged. It writes structured text records, deduplicated as
+// in Default, to l.Writer(); l's prefix and flags are not applied.
+func FromStdLog(l *stdlog.Logger) *slog.Logger {
+	if l == nil {
+		return Default()
+	}
+
+	return slog.New(NewDedupHandler(slog.NewTextHandler(l.Writer(), nil)))
+}
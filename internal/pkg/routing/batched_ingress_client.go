@@ -1,15 +1,41 @@
 package routing
 
 import (
-	"log"
+	stdlog "log"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	batching "code.cloudfoundry.org/go-batching"
 	diodes "code.cloudfoundry.org/go-diodes"
 	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"code.cloudfoundry.org/log-cache/internal/pkg/logging"
 	rpc "code.cloudfoundry.org/log-cache/rpc/logcache_v1"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultDiodeSize is the capacity of the in-memory diode used to buffer
+// envelopes before they're handed to the batcher. Once the diode is this
+// close to full, new envelopes spill to disk instead of overwriting
+// unread ones.
+const defaultDiodeSize = 10000
+
+// spillWatermark is the fraction of defaultDiodeSize at which incoming
+// envelopes are spilled to disk rather than written straight to the
+// diode.
+const spillWatermark = 0.9
+
+const (
+	defaultMaxInflight     = 1
+	defaultSendTimeout     = 3 * time.Second
+	defaultMaxRetries      = 0
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultMaxRetryBackoff = 5 * time.Second
 )
 
 // BatchedIngressClient batches envelopes before sending it. Each invocation
@@ -17,10 +43,32 @@ import (
 type BatchedIngressClient struct {
 	c rpc.IngressClient
 
-	buffer   *diodes.OneToOne
-	size     int
-	interval time.Duration
-	log      *log.Logger
+	buffer    *diodes.OneToOne
+	bufferLen int64 // atomically accessed approximation of buffer depth
+	size      int
+	interval  time.Duration
+	logger    *slog.Logger
+
+	spill         *diskSpillQueue
+	maxSpillBytes int64
+	maxSpillFiles int
+
+	maxInflight     int
+	sem             chan struct{}
+	sendTimeout     time.Duration
+	maxRetries      int
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	dropped           func(uint64)
+	spilledToDisk     func(uint64)
+	spillBytesMetric  func(uint64)
+	recoveredFromDisk func(uint64)
+	retriesExhausted  func(uint64)
 }
 
 // Metrics registers new Counter metrics.
@@ -30,67 +78,329 @@ type Metrics interface {
 	NewCounter(name string) func(delta uint64)
 }
 
-// NewBatchedIngressClient returns a new BatchedIngressClient.
+// BatchedIngressClientOption configures a BatchedIngressClient.
+type BatchedIngressClientOption func(*BatchedIngressClient)
+
+// WithSpillDir enables disk-backed spillover: once the in-memory diode is
+// nearly full, incoming envelopes are appended to a segmented queue under
+// dir instead of being dropped. Without this option, a full diode drops
+// envelopes exactly as before.
+func WithSpillDir(dir string) BatchedIngressClientOption {
+	return func(b *BatchedIngressClient) {
+		q, err := newDiskSpillQueue(dir, b.maxSpillBytes, b.maxSpillFiles)
+		if err != nil {
+			b.logger.Error("failed to open spill dir, spillover disabled", "dir", dir, "err", err)
+			return
+		}
+		b.spill = q
+	}
+}
+
+// WithMaxSpillBytes caps the size of an individual spill segment file. It
+// has no effect unless WithSpillDir is also given, and works regardless of
+// whether it's given before or after WithSpillDir.
+func WithMaxSpillBytes(n int64) BatchedIngressClientOption {
+	return func(b *BatchedIngressClient) {
+		b.maxSpillBytes = n
+		if b.spill != nil {
+			b.spill.maxFileBytes = n
+		}
+	}
+}
+
+// WithMaxSpillFiles caps the number of spill segment files kept on disk.
+// Once exceeded, the oldest segment is dropped to make room for new
+// spillover. Like WithMaxSpillBytes, it works regardless of whether it's
+// given before or after WithSpillDir.
+func WithMaxSpillFiles(n int) BatchedIngressClientOption {
+	return func(b *BatchedIngressClient) {
+		b.maxSpillFiles = n
+		if b.spill != nil {
+			b.spill.maxFiles = n
+		}
+	}
+}
+
+// WithMaxInflight bounds the number of batches that may be in flight to
+// the ingress client concurrently. The default is 1, matching the
+// previous, strictly sequential behavior.
+func WithMaxInflight(n int) BatchedIngressClientOption {
+	return func(b *BatchedIngressClient) {
+		b.maxInflight = n
+	}
+}
+
+// WithSendTimeout overrides the per-batch RPC timeout. The default is 3
+// seconds.
+func WithSendTimeout(d time.Duration) BatchedIngressClientOption {
+	return func(b *BatchedIngressClient) {
+		b.sendTimeout = d
+	}
+}
+
+// WithMaxRetries enables retrying a batch up to n times on a transient
+// gRPC error (Unavailable, DeadlineExceeded, ResourceExhausted) before it
+// is dropped. The default is 0 (no retries).
+func WithMaxRetries(n int) BatchedIngressClientOption {
+	return func(b *BatchedIngressClient) {
+		b.maxRetries = n
+	}
+}
+
+// WithRetryBackoff sets the base and max delay used for full-jitter
+// exponential backoff between retries.
+func WithRetryBackoff(base, max time.Duration) BatchedIngressClientOption {
+	return func(b *BatchedIngressClient) {
+		b.retryBackoff = base
+		b.maxRetryBackoff = max
+	}
+}
+
+// NewBatchedIngressClient returns a new BatchedIngressClient. A nil
+// logger falls back to a text handler on stderr.
 func NewBatchedIngressClient(
 	size int,
 	interval time.Duration,
 	c rpc.IngressClient,
 	m Metrics,
-	log *log.Logger,
+	logger *slog.Logger,
+	opts ...BatchedIngressClientOption,
 ) *BatchedIngressClient {
-	dropped := m.NewCounter("Dropped")
+	if logger == nil {
+		logger = logging.Default()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	b := &BatchedIngressClient{
 		c:        c,
 		size:     size,
 		interval: interval,
-		log:      log,
+		logger:   logger,
+
+		maxInflight:     defaultMaxInflight,
+		sendTimeout:     defaultSendTimeout,
+		maxRetries:      defaultMaxRetries,
+		retryBackoff:    defaultRetryBackoff,
+		maxRetryBackoff: defaultMaxRetryBackoff,
+
+		ctx:    ctx,
+		cancel: cancel,
 
-		buffer: diodes.NewOneToOne(10000, diodes.AlertFunc(func(missed int) {
-			log.Printf("Dropped %d envelopes", missed)
-			dropped(uint64(missed))
-		})),
+		dropped:           m.NewCounter("Dropped"),
+		spilledToDisk:     m.NewCounter("SpilledToDisk"),
+		spillBytesMetric:  m.NewCounter("SpillBytes"),
+		recoveredFromDisk: m.NewCounter("RecoveredFromDisk"),
+		retriesExhausted:  m.NewCounter("RetriesExhausted"),
 	}
 
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	b.sem = make(chan struct{}, b.maxInflight)
+
+	b.buffer = diodes.NewOneToOne(defaultDiodeSize, diodes.AlertFunc(func(missed int) {
+		b.logger.Warn("dropped envelopes", "count", missed, "source", "ingress_diode")
+		b.dropped(uint64(missed))
+		// These entries were overwritten by the diode itself and will
+		// never individually come back out of TryNext, so bufferLen
+		// must be corrected here or it permanently overestimates
+		// occupancy once the diode has overflowed even once.
+		atomic.AddInt64(&b.bufferLen, -int64(missed))
+	}))
+
+	b.wg.Add(1)
 	go b.start()
 
 	return b
 }
 
-// Send batches envelopes before shipping them to the client.
+// WithLogger adapts a *log.Logger to the slog-based logger
+// NewBatchedIngressClient expects, for callers that haven't migrated off
+// the standard library logger yet.
+func WithLogger(l *stdlog.Logger) BatchedIngressClientOption {
+	return func(b *BatchedIngressClient) {
+		b.logger = logging.FromStdLog(l)
+	}
+}
+
+// Close stops the client from accepting further batches, drains the
+// in-memory diode (and disk spill queue, if any) into the ingress
+// client, waits for in-flight sends to complete, and returns.
+func (b *BatchedIngressClient) Close() {
+	b.cancel()
+	b.wg.Wait()
+}
+
+// Send batches envelopes before shipping them to the client. Once the
+// in-memory diode is nearly full, envelopes overflow to the on-disk spill
+// queue (if configured) rather than overwriting unread entries; they're
+// only dropped once both tiers are full. Enqueueing stops as soon as
+// ctx is canceled.
 func (b *BatchedIngressClient) Send(ctx context.Context, in *rpc.SendRequest, opts ...grpc.CallOption) (*rpc.SendResponse, error) {
 	for i := range in.GetEnvelopes().GetBatch() {
-		b.buffer.Set(diodes.GenericDataType(in.Envelopes.Batch[i]))
+		select {
+		case <-ctx.Done():
+			return &rpc.SendResponse{}, ctx.Err()
+		default:
+		}
+
+		e := in.Envelopes.Batch[i]
+
+		if b.spill != nil && atomic.LoadInt64(&b.bufferLen) >= int64(spillWatermark*defaultDiodeSize) {
+			n, dropped, err := b.spill.push(e)
+			if err != nil {
+				b.logger.Error("failed to spill envelope to disk", "err", err)
+				b.setBuffer(e)
+				continue
+			}
+
+			b.spilledToDisk(1)
+			b.spillBytesMetric(uint64(n))
+			if dropped {
+				b.dropped(1)
+			}
+			continue
+		}
+
+		b.setBuffer(e)
 	}
 
 	return &rpc.SendResponse{}, nil
 }
 
+// setBuffer writes an envelope to the in-memory diode, tracking its
+// approximate depth so Send knows when to start spilling to disk.
+func (b *BatchedIngressClient) setBuffer(e *loggregator_v2.Envelope) {
+	atomic.AddInt64(&b.bufferLen, 1)
+	b.buffer.Set(diodes.GenericDataType(e))
+}
+
 func (b *BatchedIngressClient) start() {
+	defer b.wg.Done()
+
 	batcher := batching.NewBatcher(b.size, b.interval, batching.WriterFunc(b.write))
 	for {
 		e, ok := b.buffer.TryNext()
 		if !ok {
+			if b.drainSpill(batcher) {
+				continue
+			}
+
+			if b.ctx.Err() != nil && b.drained() {
+				batcher.Flush()
+				return
+			}
+
 			batcher.Flush()
 			time.Sleep(50 * time.Millisecond)
 			continue
 		}
+		atomic.AddInt64(&b.bufferLen, -1)
 		batcher.Write((*loggregator_v2.Envelope)(e))
 	}
 }
 
+// drained reports whether both the in-memory diode and the disk spill
+// queue (if any) have been fully consumed.
+func (b *BatchedIngressClient) drained() bool {
+	return atomic.LoadInt64(&b.bufferLen) == 0 && (b.spill == nil || b.spill.empty())
+}
+
+// drainSpill moves a single envelope from the on-disk spill queue back
+// into the batcher whenever the diode has drained, so spilled-to-disk
+// envelopes are recovered as soon as there's room for them.
+func (b *BatchedIngressClient) drainSpill(batcher *batching.Batcher) bool {
+	if b.spill == nil || b.spill.empty() {
+		return false
+	}
+
+	e, ok, err := b.spill.pop()
+	if err != nil {
+		b.logger.Error("failed to recover spilled envelope", "err", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	b.recoveredFromDisk(1)
+	batcher.Write(e)
+	return true
+}
+
+// write hands a batch off to a semaphore-guarded worker so at most
+// maxInflight batches are ever in flight to the ingress client at once.
 func (b *BatchedIngressClient) write(batch []interface{}) {
 	var e []*loggregator_v2.Envelope
 	for _, i := range batch {
 		e = append(e, i.(*loggregator_v2.Envelope))
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 3*time.Second)
-	_, err := b.c.Send(ctx, &rpc.SendRequest{
-		LocalOnly: true,
-		Envelopes: &loggregator_v2.EnvelopeBatch{e},
-	})
+	b.wg.Add(1)
+	b.sem <- struct{}{}
+	go func() {
+		defer b.wg.Done()
+		defer func() { <-b.sem }()
+		b.sendWithRetry(e)
+	}()
+}
 
-	if err != nil {
-		b.log.Printf("failed to write envelope: %s", err)
+// sendWithRetry sends a batch, retrying transient gRPC errors with full-
+// jitter exponential backoff up to maxRetries times before giving up and
+// incrementing RetriesExhausted. The per-attempt RPC context is derived
+// from context.Background(), not b.ctx: b.ctx is canceled by Close to
+// signal start() to stop pulling new work off the diode, and a send
+// derived from an already-canceled context would fail instantly,
+// dropping exactly the in-flight and still-draining batches Close is
+// meant to flush.
+func (b *BatchedIngressClient) sendWithRetry(e []*loggregator_v2.Envelope) {
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), b.sendTimeout)
+		_, err := b.c.Send(ctx, &rpc.SendRequest{
+			LocalOnly: true,
+			Envelopes: &loggregator_v2.EnvelopeBatch{e},
+		})
+		cancel()
+
+		if err == nil {
+			return
+		}
+
+		if !isTransient(err) || attempt >= b.maxRetries {
+			if attempt >= b.maxRetries && isTransient(err) {
+				b.retriesExhausted(1)
+			}
+			b.logger.Error("send failed", "err", err, "batch_size", len(e))
+			return
+		}
+
+		select {
+		case <-time.After(fullJitterBackoff(b.retryBackoff, b.maxRetryBackoff, attempt)):
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+// isTransient reports whether err is a gRPC error worth retrying.
+func isTransient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	default:
+		return false
 	}
-}
\ No newline at end of file
+}
+
+// fullJitterBackoff returns a random duration in [0, min(max, base*2^attempt)],
+// per the "full jitter" strategy.
+func fullJitterBackoff(base, max time.Duration, attempt int) time.Duration {
+	backoff := base << uint(attempt)
+	if backoff <= 0 || backoff > max {
+		backoff = max
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
@@ -0,0 +1,259 @@
+package routing_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"code.cloudfoundry.org/log-cache/internal/pkg/routing"
+	rpc "code.cloudfoundry.org/log-cache/rpc/logcache_v1"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BatchedIngressClient", func() {
+	var (
+		client  *spyIngressClient
+		metrics *spyMetrics
+	)
+
+	BeforeEach(func() {
+		client = newSpyIngressClient()
+		metrics = newSpyMetrics()
+	})
+
+	It("retries a transient failure until it succeeds", func() {
+		client.failTimes(2, codes.Unavailable)
+
+		b := routing.NewBatchedIngressClient(1, time.Millisecond, client, metrics, nil,
+			routing.WithMaxRetries(5),
+			routing.WithRetryBackoff(time.Millisecond, 5*time.Millisecond),
+		)
+		defer b.Close()
+
+		_, err := b.Send(context.Background(), sendRequest("a"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(client.envelopeIDs).Should(ConsistOf("a"))
+		Expect(metrics.count("RetriesExhausted")).To(Equal(uint64(0)))
+	})
+
+	It("gives up and counts RetriesExhausted once retries are used up", func() {
+		client.failAlways(codes.Unavailable)
+
+		b := routing.NewBatchedIngressClient(1, time.Millisecond, client, metrics, nil,
+			routing.WithMaxRetries(2),
+			routing.WithRetryBackoff(time.Millisecond, 5*time.Millisecond),
+		)
+		defer b.Close()
+
+		_, err := b.Send(context.Background(), sendRequest("a"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(func() uint64 { return metrics.count("RetriesExhausted") }).Should(Equal(uint64(1)))
+	})
+
+	It("drains everything still buffered by the time Close returns", func() {
+		b := routing.NewBatchedIngressClient(1, time.Millisecond, client, metrics, nil)
+
+		for _, id := range []string{"a", "b", "c"} {
+			_, err := b.Send(context.Background(), sendRequest(id))
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		b.Close()
+
+		Expect(client.envelopeIDs()).To(ConsistOf("a", "b", "c"))
+	})
+
+	It("spills to disk once the diode nears full, and recovers once it drains", func() {
+		release := client.gateSends()
+
+		dir, err := ioutil.TempDir("", "spill-integration-test")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		b := routing.NewBatchedIngressClient(1, time.Millisecond, client, metrics, nil,
+			routing.WithSpillDir(dir),
+			routing.WithMaxSpillBytes(0),
+			routing.WithMaxSpillFiles(0),
+		)
+		defer b.Close()
+
+		// maxInflight defaults to 1, so the very first batch's send blocks
+		// forever on the gate, stalling the drain loop and forcing
+		// everything sent after it to back up in the diode and, once the
+		// spill watermark is crossed, over onto disk.
+		for i := 0; i < 9500; i++ {
+			_, err := b.Send(context.Background(), sendRequest(fmt.Sprintf("env-%d", i)))
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		Eventually(func() uint64 { return metrics.count("SpilledToDisk") }, 2*time.Second).Should(BeNumerically(">", 0))
+
+		release()
+
+		Eventually(func() uint64 { return metrics.count("RecoveredFromDisk") }, 2*time.Second).Should(BeNumerically(">", 0))
+	})
+
+	It("never dispatches more than maxInflight batches at once", func() {
+		release := client.gateSends()
+
+		b := routing.NewBatchedIngressClient(1, time.Millisecond, client, metrics, nil,
+			routing.WithMaxInflight(2),
+		)
+		defer b.Close()
+		defer release()
+
+		for i := 0; i < 5; i++ {
+			_, err := b.Send(context.Background(), sendRequest(fmt.Sprintf("env-%d", i)))
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		Eventually(client.inFlight, time.Second).Should(Equal(2))
+		Consistently(client.inFlight, 200*time.Millisecond).Should(Equal(2))
+		Expect(client.maxObservedInFlight()).To(Equal(2))
+	})
+})
+
+func sendRequest(sourceID string) *rpc.SendRequest {
+	return &rpc.SendRequest{
+		Envelopes: &loggregator_v2.EnvelopeBatch{
+			Batch: []*loggregator_v2.Envelope{
+				{SourceId: sourceID},
+			},
+		},
+	}
+}
+
+type spyIngressClient struct {
+	rpc.IngressClient
+
+	mu            sync.Mutex
+	received      []string
+	failCode      codes.Code
+	failTimesLeft int
+	alwaysFail    bool
+	gate          chan struct{}
+
+	inFlightCount   int32
+	maxInFlightSeen int32
+}
+
+func newSpyIngressClient() *spyIngressClient {
+	return &spyIngressClient{}
+}
+
+func (s *spyIngressClient) failTimes(n int, code codes.Code) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failTimesLeft = n
+	s.failCode = code
+}
+
+func (s *spyIngressClient) failAlways(code codes.Code) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.alwaysFail = true
+	s.failCode = code
+}
+
+// gateSends makes every subsequent Send block until the returned release
+// func is called, so a test can hold batches "in flight" to observe
+// backpressure (spillover, the maxInflight bound) before letting them
+// complete.
+func (s *spyIngressClient) gateSends() (release func()) {
+	gate := make(chan struct{})
+
+	s.mu.Lock()
+	s.gate = gate
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(gate) }) }
+}
+
+// inFlight reports how many Send calls are currently blocked on the gate.
+func (s *spyIngressClient) inFlight() int {
+	return int(atomic.LoadInt32(&s.inFlightCount))
+}
+
+// maxObservedInFlight reports the highest concurrency inFlight ever
+// reached over the life of the spy.
+func (s *spyIngressClient) maxObservedInFlight() int {
+	return int(atomic.LoadInt32(&s.maxInFlightSeen))
+}
+
+func (s *spyIngressClient) Send(ctx context.Context, in *rpc.SendRequest, opts ...grpc.CallOption) (*rpc.SendResponse, error) {
+	s.mu.Lock()
+	gate := s.gate
+	s.mu.Unlock()
+
+	if gate != nil {
+		n := atomic.AddInt32(&s.inFlightCount, 1)
+		for {
+			seen := atomic.LoadInt32(&s.maxInFlightSeen)
+			if n <= seen || atomic.CompareAndSwapInt32(&s.maxInFlightSeen, seen, n) {
+				break
+			}
+		}
+		<-gate
+		atomic.AddInt32(&s.inFlightCount, -1)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.alwaysFail || s.failTimesLeft > 0 {
+		if s.failTimesLeft > 0 {
+			s.failTimesLeft--
+		}
+		return nil, status.Error(s.failCode, "transient failure")
+	}
+
+	for _, e := range in.GetEnvelopes().GetBatch() {
+		s.received = append(s.received, e.GetSourceId())
+	}
+
+	return &rpc.SendResponse{}, nil
+}
+
+func (s *spyIngressClient) envelopeIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]string, len(s.received))
+	copy(out, s.received)
+	return out
+}
+
+type spyMetrics struct {
+	mu       sync.Mutex
+	counters map[string]uint64
+}
+
+func newSpyMetrics() *spyMetrics {
+	return &spyMetrics{counters: map[string]uint64{}}
+}
+
+func (s *spyMetrics) NewCounter(name string) func(uint64) {
+	return func(delta uint64) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.counters[name] += delta
+	}
+}
+
+func (s *spyMetrics) count(name string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counters[name]
+}
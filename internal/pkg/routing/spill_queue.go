@@ -0,0 +1,269 @@
+package routing
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/gogo/protobuf/proto"
+)
+
+// diskSpillQueue persists envelopes to a segmented, append-only directory
+// of files when the in-memory diode can't keep up. Segments are capped in
+// size and the queue is capped in total file count, so it degrades to
+// dropping the oldest segment rather than growing without bound.
+//
+// Each record on disk is a 4-byte big-endian length prefix followed by a
+// marshaled loggregator_v2.Envelope. Segments are fsynced on every write so
+// that a crash leaves, at worst, a truncated final record, which is
+// discarded on recovery.
+type diskSpillQueue struct {
+	mu sync.Mutex
+
+	dir          string
+	maxFileBytes int64
+	maxFiles     int
+
+	segments []*spillSegment // oldest first
+	readIdx  int
+	readOff  int64
+}
+
+type spillSegment struct {
+	seq  int64
+	path string
+	size int64
+}
+
+const spillSegmentPrefix = "spill-"
+
+// newDiskSpillQueue opens (and if necessary recovers) a disk spill queue
+// rooted at dir.
+func newDiskSpillQueue(dir string, maxFileBytes int64, maxFiles int) (*diskSpillQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spill dir: %s", err)
+	}
+
+	q := &diskSpillQueue{
+		dir:          dir,
+		maxFileBytes: maxFileBytes,
+		maxFiles:     maxFiles,
+	}
+
+	if err := q.recover(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// recover rebuilds the segment list from whatever spill files are already
+// on disk, so envelopes queued before a restart aren't lost.
+func (q *diskSpillQueue) recover() error {
+	entries, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read spill dir: %s", err)
+	}
+
+	var segs []*spillSegment
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), spillSegmentPrefix) {
+			continue
+		}
+
+		seq, err := strconv.ParseInt(strings.TrimPrefix(e.Name(), spillSegmentPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segs = append(segs, &spillSegment{
+			seq:  seq,
+			path: filepath.Join(q.dir, e.Name()),
+			size: e.Size(),
+		})
+	}
+
+	sort.Slice(segs, func(i, j int) bool { return segs[i].seq < segs[j].seq })
+	q.segments = segs
+
+	return nil
+}
+
+// empty reports whether the queue has no envelopes left to recover.
+func (q *diskSpillQueue) empty() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.readIdx >= len(q.segments)
+}
+
+// push appends an envelope to the current (newest) segment, rolling over
+// to a new segment once maxFileBytes is exceeded and dropping the oldest
+// segment once maxFiles is exceeded. It returns the number of bytes
+// written and whether an old segment was dropped to make room.
+func (q *diskSpillQueue) push(e *loggregator_v2.Envelope) (bytesWritten int64, dropped bool, err error) {
+	data, err := proto.Marshal(e)
+	if err != nil {
+		return 0, false, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	seg, err := q.currentWriteSegment(int64(len(data) + 4))
+	if err != nil {
+		return 0, false, err
+	}
+
+	f, err := os.OpenFile(seg.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, 4)
+	binary.BigEndian.PutUint32(hdr, uint32(len(data)))
+
+	if _, err := f.Write(hdr); err != nil {
+		return 0, false, err
+	}
+	if _, err := f.Write(data); err != nil {
+		return 0, false, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, false, err
+	}
+
+	n := int64(len(hdr) + len(data))
+	seg.size += n
+
+	dropped = q.enforceMaxFiles()
+
+	return n, dropped, nil
+}
+
+// currentWriteSegment returns the newest segment, creating one if the
+// queue is empty or the newest segment would exceed maxFileBytes.
+func (q *diskSpillQueue) currentWriteSegment(nextWrite int64) (*spillSegment, error) {
+	if len(q.segments) == 0 {
+		return q.newSegment(1)
+	}
+
+	last := q.segments[len(q.segments)-1]
+	if q.maxFileBytes > 0 && last.size+nextWrite > q.maxFileBytes {
+		return q.newSegment(last.seq + 1)
+	}
+
+	return last, nil
+}
+
+func (q *diskSpillQueue) newSegment(seq int64) (*spillSegment, error) {
+	path := filepath.Join(q.dir, fmt.Sprintf("%s%020d", spillSegmentPrefix, seq))
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spill segment: %s", err)
+	}
+	f.Close()
+
+	seg := &spillSegment{seq: seq, path: path}
+	q.segments = append(q.segments, seg)
+
+	return seg, nil
+}
+
+// enforceMaxFiles drops the oldest segment(s) once the segment count
+// exceeds maxFiles. Callers must hold q.mu.
+func (q *diskSpillQueue) enforceMaxFiles() (dropped bool) {
+	if q.maxFiles <= 0 {
+		return false
+	}
+
+	for len(q.segments) > q.maxFiles {
+		oldest := q.segments[0]
+		os.Remove(oldest.path)
+		q.segments = q.segments[1:]
+
+		if q.readIdx > 0 {
+			q.readIdx--
+		} else {
+			q.readOff = 0
+		}
+
+		dropped = true
+	}
+
+	return dropped
+}
+
+// pop returns the next envelope recovered from disk, in FIFO order, or
+// ok=false if the queue has nothing left. Fully consumed segments are
+// removed from disk.
+func (q *diskSpillQueue) pop() (e *loggregator_v2.Envelope, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.readIdx < len(q.segments) {
+		seg := q.segments[q.readIdx]
+
+		env, n, perr := readRecordAt(seg.path, q.readOff)
+		if perr == io.EOF {
+			os.Remove(seg.path)
+			q.segments = q.segments[1:]
+			q.readIdx = 0
+			q.readOff = 0
+			continue
+		}
+		if perr != nil {
+			return nil, false, perr
+		}
+
+		q.readOff += n
+		if q.readOff >= seg.size {
+			os.Remove(seg.path)
+			q.segments = q.segments[1:]
+			q.readIdx = 0
+			q.readOff = 0
+		}
+		return env, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// readRecordAt reads a single length-prefixed record starting at offset
+// off, returning the number of bytes consumed. A truncated trailing
+// record (e.g. from a crash mid-write) is treated as io.EOF.
+func readRecordAt(path string, off int64) (*loggregator_v2.Envelope, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, 4)
+	if _, err := f.ReadAt(hdr, off); err != nil {
+		return nil, 0, io.EOF
+	}
+
+	size := binary.BigEndian.Uint32(hdr)
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, off+4); err != nil {
+		return nil, 0, io.EOF
+	}
+
+	var e loggregator_v2.Envelope
+	if err := proto.Unmarshal(data, &e); err != nil {
+		return nil, 0, err
+	}
+
+	return &e, int64(4 + len(data)), nil
+}